@@ -0,0 +1,228 @@
+// Package capnpfs adapts a filesystem.Directory capability to the
+// standard io/fs interfaces, so that the rest of the Go ecosystem
+// (io/fs.WalkDir, io/fs.Glob, archive/zip, testing/fstest, and so on)
+// can be pointed directly at a Sandstorm filesystem grant without
+// any custom RPC glue.
+package capnpfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"zenhack.net/go/sandstorm-filesystem/filesystem"
+	util_capnp "zenhack.net/go/sandstorm/capnp/util"
+	"zenhack.net/go/sandstorm/util"
+)
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+// FS wraps a filesystem.Directory capability so it can be used
+// anywhere an io/fs.FS is expected. Names follow io/fs conventions:
+// slash-separated, relative, with "." denoting root.
+type FS struct {
+	ctx  context.Context
+	root filesystem.Directory
+}
+
+// New returns an FS backed by root. Calls issued against the
+// returned FS use ctx for their underlying RPCs.
+func New(ctx context.Context, root filesystem.Directory) *FS {
+	return &FS{ctx: ctx, root: root}
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	node, err := fsys.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fsys.stat(node, path.Base(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if info.isDir {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{info: info, entries: entries}, nil
+	}
+
+	file := filesystem.File{Client: node.Client}
+	pr, pw := io.Pipe()
+	readCtx, cancelRead := context.WithCancel(fsys.ctx)
+	results, err := file.Read(readCtx, func(p filesystem.File_read_Params) error {
+		p.SetStartAt(0)
+		p.SetAmount(0) // 0 means "the whole file"; see local.Node.Read.
+		p.SetSink(util_capnp.ByteStream_ServerToClient(&util.WriteCloserByteStream{WC: pw}))
+		return nil
+	}).Struct()
+	if err != nil {
+		cancelRead()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &capFile{pr: pr, info: info, cancel: results.Cancel(), cancelRead: cancelRead}, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	node, err := fsys.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.stat(node, path.Base(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// ReadDir lists name by buffering the whole Directory_Entry_Stream
+// into a slice, which is what fs.ReadDirFS callers expect.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := fsys.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := filesystem.Directory{Client: node.Client}
+
+	sink := &entryCollector{done: make(chan struct{})}
+	_, err = dir.List(fsys.ctx, func(p filesystem.Directory_list_Params) error {
+		p.SetStream(filesystem.Directory_Entry_Stream_ServerToClient(sink))
+		return nil
+	}).Struct()
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	select {
+	case <-sink.done:
+	case <-fsys.ctx.Done():
+		return nil, fsys.ctx.Err()
+	}
+	if sink.err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: sink.err}
+	}
+
+	sort.Slice(sink.entries, func(i, j int) bool {
+		return sink.entries[i].Name() < sink.entries[j].Name()
+	})
+	return sink.entries, nil
+}
+
+// resolve walks name one component at a time via repeated
+// Directory.Walk calls, mirroring how local.Node.Walk only ever
+// resolves a single component per RPC.
+func (fsys *FS) resolve(name string) (filesystem.Node, error) {
+	if !fs.ValidPath(name) {
+		return filesystem.Node{}, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	node := filesystem.Node{Client: fsys.root.Client}
+	if name == "." {
+		return node, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		dir := filesystem.Directory{Client: node.Client}
+		results, err := dir.Walk(fsys.ctx, func(p filesystem.Directory_walk_Params) error {
+			return p.SetName(part)
+		}).Struct()
+		if err != nil {
+			return filesystem.Node{}, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		node, err = results.Node()
+		if err != nil {
+			return filesystem.Node{}, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	return node, nil
+}
+
+func (fsys *FS) stat(node filesystem.Node, name string) (*fileInfo, error) {
+	results, err := node.Stat(fsys.ctx, func(filesystem.Node_stat_Params) error {
+		return nil
+	}).Struct()
+	if err != nil {
+		return nil, err
+	}
+	info, err := results.Info()
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(name, info), nil
+}
+
+func newFileInfo(name string, info filesystem.StatInfo) *fileInfo {
+	fi := &fileInfo{name: name, modTime: time.Unix(0, info.ModTimeNs())}
+	if info.Which() == filesystem.StatInfo_Which_dir {
+		fi.isDir = true
+		fi.mode = fs.ModeDir | 0555
+	} else {
+		fi.size = info.File().Size()
+		fi.mode = 0444
+	}
+	if info.Writable() {
+		fi.mode |= 0222
+	}
+	if info.Executable() {
+		fi.mode |= 0111
+	}
+	return fi
+}
+
+// entryCollector implements filesystem.Directory_Entry_Stream,
+// buffering every pushed batch until Done fires. local.Node.List
+// streams in batches of up to 1024 entries; we just accumulate them
+// all, since fs.ReadDirFS callers want a complete slice anyway.
+type entryCollector struct {
+	entries []fs.DirEntry
+	err     error
+	done    chan struct{}
+}
+
+func (s *entryCollector) Push(p filesystem.Directory_Entry_Stream_push_Params) error {
+	list, err := p.Entries()
+	if err != nil {
+		s.err = err
+		return err
+	}
+	for i := 0; i < list.Len(); i++ {
+		ent := list.At(i)
+		name, err := ent.Name()
+		if err != nil {
+			s.err = err
+			return err
+		}
+		info, err := ent.Info()
+		if err != nil {
+			s.err = err
+			return err
+		}
+		s.entries = append(s.entries, dirEntry{newFileInfo(name, info)})
+	}
+	return nil
+}
+
+func (s *entryCollector) Done(p filesystem.Directory_Entry_Stream_done_Params) error {
+	close(s.done)
+	return nil
+}
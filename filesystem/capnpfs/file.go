@@ -0,0 +1,88 @@
+package capnpfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"time"
+
+	util_capnp "zenhack.net/go/sandstorm/capnp/util"
+)
+
+// fileInfo implements fs.FileInfo (and, via dirEntry, fs.DirEntry)
+// on top of a filesystem.StatInfo already read off the wire.
+type fileInfo struct {
+	name    string
+	size    int64
+	isDir   bool
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+type dirEntry struct {
+	*fileInfo
+}
+
+func (d dirEntry) Type() fs.FileMode          { return d.mode.Type() }
+func (d dirEntry) Info() (fs.FileInfo, error) { return d.fileInfo, nil }
+
+// capFile implements fs.File for a regular file, reading from the
+// pipe that the File.read ByteStream sink is pumping into.
+type capFile struct {
+	pr         *io.PipeReader
+	info       *fileInfo
+	cancel     util_capnp.Handle
+	cancelRead context.CancelFunc
+}
+
+func (f *capFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *capFile) Read(p []byte) (int, error) { return f.pr.Read(p) }
+
+func (f *capFile) Close() error {
+	f.cancelRead()
+	if f.cancel.Client.IsValid() {
+		f.cancel.Close(context.Background())
+	}
+	return f.pr.Close()
+}
+
+// dirFile implements fs.ReadDirFile for a directory, backed by the
+// entries already fetched by FS.ReadDir.
+type dirFile struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dirFile) Close() error { return nil }
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		rest := d.entries[d.offset:]
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if d.offset >= len(d.entries) {
+		return nil, io.EOF
+	}
+	end := d.offset + n
+	if end > len(d.entries) {
+		end = len(d.entries)
+	}
+	rest := d.entries[d.offset:end]
+	d.offset = end
+	return rest, nil
+}
@@ -3,12 +3,24 @@
 package local
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"zenhack.net/go/sandstorm-filesystem/filesystem"
 	grain_capnp "zenhack.net/go/sandstorm/capnp/grain"
@@ -18,30 +30,323 @@ import (
 )
 
 var (
-	InvalidArgument = errors.New("Invalid argument")
-	IllegalFileName = errors.New("Illegal file name")
-	OpenFailed      = errors.New("Open failed")
-	NotImplemented  = errors.New("Not implemented")
+	InvalidArgument       = errors.New("Invalid argument")
+	IllegalFileName       = errors.New("Illegal file name")
+	OpenFailed            = errors.New("Open failed")
+	NotImplemented        = errors.New("Not implemented")
+	NotEmpty              = errors.New("Directory not empty")
+	ErrNotEnoughDiskSpace = errors.New("Not enough disk space")
+)
+
+// QuotaChecker is consulted by Create, Write, and a growing Truncate
+// before they open anything for writing, so a client streaming a large upload
+// gets ErrNotEnoughDiskSpace up front instead of discovering ENOSPC
+// partway through.
+type QuotaChecker interface {
+	// CheckQuota reports whether writing n more bytes onto the
+	// filesystem backing fd would be allowed. fd may be a directory
+	// (e.g. the parent a new file is being created in) or a regular
+	// file already open for the Node being written to; either way
+	// it's resolved via an fd already in hand, never a path string,
+	// so the check can't be raced the way a statfs(2)-by-path could.
+	// n is a hint from the caller and may be 0 if no hint was given;
+	// implementations shouldn't refuse solely because n is 0.
+	CheckQuota(fd *os.File, n int64) error
+}
+
+// statfsQuotaChecker is the default QuotaChecker: it only refuses a
+// write that it can tell, via statfs(2), would exceed the free space
+// on the underlying filesystem. It knows nothing about per-Node
+// budgets; those are enforced separately, alongside this check.
+type statfsQuotaChecker struct{}
+
+func (statfsQuotaChecker) CheckQuota(fd *os.File, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(fd.Fd()), &st); err != nil {
+		// We can't tell, so don't block the write on our own account;
+		// the underlying write will fail on its own if space really
+		// is short.
+		return nil
+	}
+	if uint64(n) > st.Bavail*uint64(st.Bsize) {
+		return ErrNotEnoughDiskSpace
+	}
+	return nil
+}
+
+var quotaChecker QuotaChecker = statfsQuotaChecker{}
+
+// SetQuotaChecker overrides the QuotaChecker consulted before Create,
+// Write, and a growing Truncate open anything for writing. Integrators layering their
+// own per-grain accounting on top of (or instead of) the statfs(2)
+// default should call this once at startup.
+func SetQuotaChecker(c QuotaChecker) {
+	quotaChecker = c
+}
+
+// spendBudget atomically reserves n bytes from budget, which may be
+// shared (via Walk/Create/Mkdir) with concurrently-written siblings,
+// reporting false without reserving anything if n would overdraw it.
+// budget == nil means unlimited, so it always succeeds.
+func spendBudget(budget *int64, n int64) bool {
+	if budget == nil {
+		return true
+	}
+	for {
+		remaining := atomic.LoadInt64(budget)
+		if n > remaining {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(budget, remaining, remaining-n) {
+			return true
+		}
+	}
+}
+
+// budgetedWriter wraps an io.WriteCloser and enforces a Node's byte
+// budget one chunk at a time, so a streaming upload gets a typed
+// ErrNotEnoughDiskSpace as soon as its budget is exhausted instead of
+// running until the underlying filesystem returns ENOSPC. The budget
+// may be shared with sibling Nodes written concurrently, so spending
+// goes through spendBudget rather than a plain read-check-decrement.
+type budgetedWriter struct {
+	io.WriteCloser
+	node *Node
+}
+
+func (w *budgetedWriter) Write(p []byte) (int, error) {
+	if !spendBudget(w.node.budget, int64(len(p))) {
+		return 0, ErrNotEnoughDiskSpace
+	}
+	return w.WriteCloser.Write(p)
+}
+
+// ResolutionMode selects how child path components are resolved
+// relative to a Node's directory descriptor.
+type ResolutionMode int
+
+const (
+	// ResolveAuto probes for openat2(2)/RESOLVE_BENEATH support once,
+	// at the first resolution attempt, and uses it when available,
+	// falling back to ResolveOpenat otherwise. This is the default.
+	ResolveAuto ResolutionMode = iota
+	// ResolveOpenat2 always resolves via openat2(2)/RESOLVE_BENEATH,
+	// which refuses ".." and symlink escapes for us in the kernel.
+	ResolveOpenat2
+	// ResolveOpenat always resolves with a plain openat(2) plus
+	// O_NOFOLLOW, refusing any component that turns out to be a
+	// symlink. It's what we fall back to on kernels or platforms
+	// without openat2(2); tests can force it to exercise that path.
+	ResolveOpenat
+)
+
+// resolutionMode is read on every path resolution, so callers
+// wanting ResolveOpenat2 or ResolveOpenat enforced should set it
+// before serving any requests.
+var resolutionMode = ResolveAuto
+
+// SetResolutionMode overrides how this package resolves child path
+// components beneath a Node. Integrators normally don't need this;
+// it exists so tests can force ResolveOpenat2 or ResolveOpenat
+// instead of relying on whatever the running kernel happens to
+// support.
+func SetResolutionMode(m ResolutionMode) {
+	resolutionMode = m
+}
+
+var (
+	openat2Once      sync.Once
+	openat2Supported bool
 )
 
+// haveOpenat2 probes, once, whether the running kernel supports
+// openat2(2) with RESOLVE_BENEATH by using it to open "." beneath a
+// descriptor for "/" (RESOLVE_BENEATH rejects an absolute path itself).
+func haveOpenat2() bool {
+	openat2Once.Do(func() {
+		root, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return
+		}
+		defer unix.Close(root)
+		fd, err := unix.Openat2(root, ".", &unix.OpenHow{
+			Flags:   unix.O_RDONLY | unix.O_DIRECTORY,
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+		})
+		if err == nil {
+			unix.Close(fd)
+			openat2Supported = true
+		}
+	})
+	return openat2Supported
+}
+
+func useOpenat2() bool {
+	switch resolutionMode {
+	case ResolveOpenat2:
+		return true
+	case ResolveOpenat:
+		return false
+	default:
+		return haveOpenat2()
+	}
+}
+
+// openBeneath opens name relative to dir without ever going through
+// a concatenated path, so a symlink or ".." swapped in underneath us
+// between Stat and Open can't walk us outside of dir. name must
+// already have passed validFileName, so it's always a single path
+// component.
+//
+// On Linux 5.6+ this resolves in one syscall via openat2(2) with
+// RESOLVE_BENEATH|RESOLVE_NO_MAGICLINKS, which makes the kernel
+// itself refuse any resolution that would escape dir. Everywhere
+// else we fall back to openat(2) with O_NOFOLLOW, conservatively
+// refusing the component outright if it turns out to be a symlink,
+// since we have no cheap way to prove a symlink's target wouldn't
+// escape without doing the walk ourselves.
+func openBeneath(dir *os.File, name string, flags int, mode os.FileMode) (*os.File, error) {
+	if !validFileName(name) {
+		return nil, IllegalFileName
+	}
+	if useOpenat2() {
+		fd, err := unix.Openat2(int(dir.Fd()), name, &unix.OpenHow{
+			Flags:   uint64(flags),
+			Mode:    uint64(mode),
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return os.NewFile(uintptr(fd), name), nil
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return nil, unix.ELOOP
+	}
+	fd, err := unix.Openat(int(dir.Fd()), name, flags|unix.O_NOFOLLOW, uint32(mode))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// openRoot opens path the ordinary way. It's only ever used for the
+// root of a grant (NewNode, Restore, openSelf), which is configured by the
+// integrator rather than resolved from untrusted input, so there's
+// no parent directory fd to resolve it against.
+func openRoot(path string, flags int) (*os.File, error) {
+	return os.OpenFile(path, flags, 0)
+}
+
+// openSelf reopens n with flags: via n.parent's fd, the same way
+// openBeneath resolves any other capability child, or by reopening
+// the grant root by path when n has no parent because it *is* the
+// grant root (NewNode can root a grant directly on a plain file, not
+// just a directory).
+func openSelf(n *Node, flags int) (*os.File, error) {
+	if n.parent != nil {
+		return openBeneath(n.parent, n.name, flags, 0)
+	}
+	return openRoot(n.path, flags)
+}
+
 func NewNode(path string) (*Node, error) {
-	fi, err := os.Stat(path)
+	fd, err := openRoot(path, os.O_RDONLY)
 	if err != nil {
 		return nil, err
 	}
-	return &Node{
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	node := &Node{
 		path:       path,
 		isDir:      fi.IsDir(),
 		writable:   fi.Mode()&0200 != 0,
 		executable: fi.Mode()&0100 != 0,
-	}, nil
+		fd:         fd,
+	}
+	node.root = node
+	return node, nil
 }
 
 type Node struct {
 	isDir      bool
 	writable   bool
 	executable bool
-	path       string
+	path       string // kept for Save/Restore, for reopening a grant root (see openSelf), and for diagnostics; a child Node's path is never fed back into a syscall.
+
+	fd     *os.File // open on this Node itself: a directory fd for dirs (the base for resolving children), or for files a read-only fd (read-write for a Node made by Create), the base for Fstat/Fchmod/Ftruncate.
+	parent *os.File // directory fd this Node was resolved from; nil for the grant root. Lets us re-resolve a fresh, differently-flagged fd (e.g. for Write) without ever falling back to path concatenation.
+	name   string   // the single path component this Node was resolved by, relative to parent.
+
+	root *Node // the Node this one's grant was rooted on (itself, for a grant root). Shared with every child resolved by Walk/Create/Mkdir; Rename compares it against the destination's root so a rename can't splice data between two unrelated grants that merely happen to share a mount.
+
+	budget *int64 // remaining bytes this Node's whole subtree may still add to disk; nil means unlimited. Shared (not copied) with every child resolved from this Node by Walk/Create/Mkdir, so spending by one descendant is visible to all the others; see SetBudget.
+
+	// mime, mimeMtime, and mimeSize memoize mimeType's result; see
+	// its doc comment.
+	mime      string
+	mimeMtime int64
+	mimeSize  int64
+}
+
+// SetBudget caps the total number of bytes Write and a growing
+// Truncate may add across node's whole subtree, including children
+// resolved afterwards by Walk, Create, or Mkdir: they share node's
+// counter rather than getting their own, so spending by one sibling
+// is visible to the rest instead of resetting every time a fresh
+// capability is minted. Nodes are unlimited (the zero value) until
+// an integrator opts in by calling this.
+func (node *Node) SetBudget(budget int64) {
+	node.budget = &budget
+}
+
+// nodePersisted is the on-the-wire shape of a saved Node: just enough
+// to reopen the same grant root later. Node's own fields are all
+// unexported (the RPC methods below shouldn't be driven by a
+// client-supplied struct), so Save and Restore go through this instead
+// of handing json the Node directly.
+type nodePersisted struct {
+	Path       string `json:"path"`
+	IsDir      bool   `json:"isDir"`
+	Writable   bool   `json:"writable"`
+	Executable bool   `json:"executable"`
+	Budget     *int64 `json:"budget,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler so Save can persist n's
+// identity, including whatever budget SetBudget installed, without
+// exporting Node's fields.
+func (n *Node) MarshalJSON() ([]byte, error) {
+	return json.Marshal(nodePersisted{
+		Path:       n.path,
+		IsDir:      n.isDir,
+		Writable:   n.writable,
+		Executable: n.executable,
+		Budget:     n.budget,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler so Restore can recover n's
+// identity, including its budget, before reopening its fd.
+func (n *Node) UnmarshalJSON(data []byte) error {
+	var p nodePersisted
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	n.path = p.Path
+	n.isDir = p.IsDir
+	n.writable = p.Writable
+	n.executable = p.Executable
+	n.budget = p.Budget
+	return nil
 }
 
 func (n *Node) Save(p grain_capnp.AppPersistent_save) error {
@@ -66,13 +371,21 @@ func (n *Node) Restore(p grain_capnp.MainView_restore) error {
 	if err != nil {
 		return err
 	}
+
+	fd, err := openRoot(n.path, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	n.fd = fd
+	n.root = n
+
 	capId := p.Results.Struct.Segment().Message().AddCap(n.MakeClient().Client)
 	p.Results.SetCapPtr(capnp.NewInterface(p.Results.Struct.Segment(), capId).ToPtr())
 	return nil
 }
 
 func (n *Node) Stat(p filesystem.Node_stat) error {
-	fi, err := os.Stat(n.path)
+	fi, err := n.fd.Stat()
 	if err != nil {
 		// TODO: think about the right way to handle this.
 		return err
@@ -86,12 +399,80 @@ func (n *Node) Stat(p filesystem.Node_stat) error {
 	} else {
 		info.SetFile()
 		info.File().SetSize(fi.Size())
+
+		if mime, err := n.mimeType(fi); err == nil {
+			info.File().SetMimeType(mime)
+		}
+
+		if p.Params.WantHash() {
+			if hash, err := n.fileHash(); err == nil {
+				info.File().SetHash(hash)
+			}
+		}
 	}
 	info.SetWritable(n.writable)
 	info.SetExecutable(n.executable)
+	info.SetModTimeNs(fi.ModTime().UnixNano())
 	return nil
 }
 
+// extensionMimeOverrides covers extensions that net/http.DetectContentType
+// is known to get wrong (it only looks at content, and these formats
+// don't have a reliable enough magic number for it to recognize).
+var extensionMimeOverrides = map[string]string{
+	".md":   "text/markdown; charset=utf-8",
+	".svg":  "image/svg+xml",
+	".wasm": "application/wasm",
+	".css":  "text/css; charset=utf-8",
+	".json": "application/json",
+}
+
+// mimeType returns n's MIME type, memoized on n keyed by (mtime,
+// size) so repeated Stats of an unchanged file don't re-read it. On
+// a cache miss, it first checks extensionMimeOverrides, then falls
+// back to sniffing the first 512 bytes with http.DetectContentType.
+func (n *Node) mimeType(fi os.FileInfo) (string, error) {
+	mtime, size := fi.ModTime().UnixNano(), fi.Size()
+	if n.mime != "" && n.mimeMtime == mtime && n.mimeSize == size {
+		return n.mime, nil
+	}
+
+	if ext := filepath.Ext(n.name); ext != "" {
+		if mime, ok := extensionMimeOverrides[strings.ToLower(ext)]; ok {
+			n.mime, n.mimeMtime, n.mimeSize = mime, mtime, size
+			return mime, nil
+		}
+	}
+
+	var buf [512]byte
+	read, err := n.fd.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	mime := http.DetectContentType(buf[:read])
+
+	n.mime, n.mimeMtime, n.mimeSize = mime, mtime, size
+	return mime, nil
+}
+
+// fileHash streams n's contents through sha256, so it works on files
+// larger than memory, and returns the digest hex-encoded. It's only
+// called when the caller opts in via Node_stat's wantHash flag, since
+// it means reading the whole file.
+func (n *Node) fileHash() (string, error) {
+	file, err := openSelf(n, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 type cancelHandle context.CancelFunc
 
 func (c cancelHandle) Close() error {
@@ -101,13 +482,18 @@ func (c cancelHandle) Close() error {
 
 func (d *Node) List(p filesystem.Directory_list) error {
 	stream := p.Params.Stream()
-	file, err := os.Open(d.path)
+
+	// Reopen "." beneath d.fd rather than reusing d.fd directly: the
+	// goroutine below advances the fd's read offset and closes it when
+	// done, and we don't want that to disturb d.fd, which this Node
+	// keeps open for the rest of its life. (A dup(2) would share d.fd's
+	// offset, so a second List would start at the end.)
+	dupFd, err := unix.Openat(int(d.fd.Fd()), ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
 	if err != nil {
-		// err might contain private info, e.g. where the directory
-		// is rooted. So we return a generic error. It might be nice
-		// to find some way to allow more information for debugging.
 		return OpenFailed
 	}
+	file := os.NewFile(uintptr(dupFd), d.path)
+
 	ctx, cancel := context.WithCancel(p.Ctx)
 	p.Results.SetCancel(util_capnp.Handle_ServerToClient(cancelHandle(cancel)))
 	go func() {
@@ -159,6 +545,223 @@ func (d *Node) List(p filesystem.Directory_list) error {
 	return nil
 }
 
+// Export streams d's subtree to the caller's sink as a single tar or
+// zip archive, so a client can download a whole folder in one
+// round-trip instead of a walk+read per file. The archive format is
+// picked by the caller the same way Read lets the caller pick a
+// start offset and length.
+func (d *Node) Export(p filesystem.Directory_export) error {
+	format := p.Params.Format()
+	sink := p.Params.Sink()
+
+	ctx, cancel := context.WithCancel(p.Ctx)
+	p.Results.SetCancel(util_capnp.Handle_ServerToClient(cancelHandle(cancel)))
+
+	go func() {
+		wc := util.ByteStreamWriteCloser{ctx, sink}
+		defer wc.Close()
+
+		if format == filesystem.ExportFormat_zip {
+			exportZip(ctx, d, wc)
+		} else {
+			exportTar(ctx, d, wc)
+		}
+	}()
+	return nil
+}
+
+// exportEntry describes one node encountered by walkBeneath, with
+// everything exportTar/exportZip need to write it without ever
+// touching a path again.
+type exportEntry struct {
+	rel       string
+	isDir     bool
+	isSymlink bool
+	target    string // set only when isSymlink
+	mode      os.FileMode
+	size      int64
+	modTime   time.Time
+	fd        *os.File // open read-only on the entry; nil for directories and symlinks. Owned by the caller of walkBeneath: close it after use.
+}
+
+// walkBeneath walks root's subtree entirely through open directory
+// fds: every child, not just symlinks, is resolved with openBeneath
+// relative to its listed parent's fd, the same way Walk resolves a
+// capability child. Unlike filepath.WalkDir plus os.Open against a
+// reassembled path, nothing here ever re-resolves a name from a
+// string once its parent fd is in hand, so a writer racing the
+// export can't swap a regular file or a directory component for a
+// symlink between being listed and being opened.
+func walkBeneath(ctx context.Context, root *Node, visit func(exportEntry) error) error {
+	rootDup, err := unix.Openat(int(root.fd.Fd()), ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	type frame struct {
+		fd  *os.File
+		rel string
+	}
+	stack := []frame{{fd: os.NewFile(uintptr(rootDup), root.path), rel: ""}}
+
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		names, err := cur.fd.Readdirnames(-1)
+		if err != nil {
+			cur.fd.Close()
+			continue
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if ctx.Err() != nil {
+				cur.fd.Close()
+				return ctx.Err()
+			}
+
+			rel := name
+			if cur.rel != "" {
+				rel = cur.rel + "/" + name
+			}
+
+			var st unix.Stat_t
+			if err := unix.Fstatat(int(cur.fd.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				continue
+			}
+
+			if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+				// Confirm the link resolves beneath cur.fd the same
+				// way a Walk RPC would; if openBeneath refuses it
+				// (its target escapes cur.fd's directory or does not
+				// exist, or, under ResolveOpenat, it is a symlink at
+				// all), drop it rather than hand the caller a target
+				// it can't follow.
+				child, err := openBeneath(cur.fd, name, os.O_RDONLY, 0)
+				if err != nil {
+					continue
+				}
+				child.Close()
+
+				buf := make([]byte, st.Size+1)
+				n, err := unix.Readlinkat(int(cur.fd.Fd()), name, buf)
+				if err != nil {
+					continue
+				}
+				if err := visit(exportEntry{rel: rel, isSymlink: true, target: string(buf[:n])}); err != nil {
+					cur.fd.Close()
+					return err
+				}
+				continue
+			}
+
+			child, err := openBeneath(cur.fd, name, os.O_RDONLY, 0)
+			if err != nil {
+				continue
+			}
+			fi, err := child.Stat()
+			if err != nil {
+				child.Close()
+				continue
+			}
+
+			entry := exportEntry{
+				rel:     rel,
+				isDir:   fi.IsDir(),
+				mode:    fi.Mode(),
+				size:    fi.Size(),
+				modTime: fi.ModTime(),
+			}
+			if entry.isDir {
+				if err := visit(entry); err != nil {
+					child.Close()
+					cur.fd.Close()
+					return err
+				}
+				stack = append(stack, frame{fd: child, rel: rel})
+				continue
+			}
+
+			entry.fd = child
+			err = visit(entry)
+			child.Close()
+			if err != nil {
+				cur.fd.Close()
+				return err
+			}
+		}
+		cur.fd.Close()
+	}
+	return nil
+}
+
+// exportTar walks root's subtree and writes it as a tar stream to w.
+func exportTar(ctx context.Context, root *Node, w io.Writer) {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	walkBeneath(ctx, root, func(e exportEntry) error {
+		if e.isSymlink {
+			return tw.WriteHeader(&tar.Header{
+				Name:     e.rel,
+				Typeflag: tar.TypeSymlink,
+				Linkname: e.target,
+			})
+		}
+
+		hdr := &tar.Header{
+			Name:    e.rel,
+			Size:    e.size,
+			Mode:    int64(e.mode.Perm()),
+			ModTime: e.modTime,
+		}
+		if e.isDir {
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+			return tw.WriteHeader(hdr)
+		}
+		hdr.Typeflag = tar.TypeReg
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, e.fd)
+		return err
+	})
+}
+
+// exportZip mirrors exportTar but for the zip format. archive/zip has
+// no first-class symlink entry, so symlinks are skipped rather than
+// flattened into a copy of their target's contents.
+func exportZip(ctx context.Context, root *Node, w io.Writer) {
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	walkBeneath(ctx, root, func(e exportEntry) error {
+		if e.isSymlink {
+			return nil
+		}
+
+		hdr := &zip.FileHeader{
+			Name:     e.rel,
+			Modified: e.modTime,
+		}
+		hdr.SetMode(e.mode)
+		if e.isDir {
+			hdr.Name += "/"
+			_, err := zw.CreateHeader(hdr)
+			return err
+		}
+		hdr.Method = zip.Deflate
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, e.fd)
+		return err
+	})
+}
+
 func (d *Node) Walk(p filesystem.Directory_walk) error {
 	name, err := p.Params.Name()
 	if err != nil {
@@ -169,17 +772,27 @@ func (d *Node) Walk(p filesystem.Directory_walk) error {
 		return IllegalFileName
 	}
 
-	path := d.path + "/" + name
-	fi, err := os.Stat(path)
+	child, err := openBeneath(d.fd, name, os.O_RDONLY, 0)
 	if err != nil {
-		return err
+		return OpenFailed
+	}
+
+	fi, err := child.Stat()
+	if err != nil {
+		child.Close()
+		return OpenFailed
 	}
 
 	node := &Node{
-		path:       path,
+		path:       d.path + "/" + name,
 		isDir:      fi.IsDir(),
 		writable:   d.writable && fi.Mode()&0200 != 0,
 		executable: fi.Mode()&0100 != 0,
+		fd:         child,
+		parent:     d.fd,
+		name:       name,
+		root:       d.root,
+		budget:     d.budget,
 	}
 
 	p.Results.SetNode(node.MakeClient())
@@ -195,33 +808,160 @@ func (d *Node) Create(p filesystem.RwDirectory_create) error {
 		return IllegalFileName
 	}
 
-	node := Node{
-		path:       d.path + "/" + name,
-		executable: p.Params.Executable(),
-		writable:   true,
-	}
-
+	executable := p.Params.Executable()
 	mode := os.FileMode(0644)
-	if node.executable {
+	if executable {
 		mode |= 0111
 	}
 
-	file, err := os.OpenFile(node.path, os.O_RDWR|os.O_CREATE, mode)
+	if err := quotaChecker.CheckQuota(d.fd, 0); err != nil {
+		return err
+	}
+
+	file, err := openBeneath(d.fd, name, os.O_RDWR|os.O_CREATE, mode)
 	if err != nil {
 		return OpenFailed
 	}
-	file.Close()
+
+	node := Node{
+		path:       d.path + "/" + name,
+		executable: executable,
+		writable:   true,
+		fd:         file,
+		parent:     d.fd,
+		name:       name,
+		root:       d.root,
+		budget:     d.budget,
+	}
 
 	p.Results.SetFile(filesystem.RwFile_ServerToClient(&node))
 	return nil
 }
 
 func (d *Node) Mkdir(p filesystem.RwDirectory_mkdir) error {
-	return NotImplemented
+	name, err := p.Params.Name()
+	if err != nil {
+		return err
+	}
+	if !validFileName(name) {
+		return IllegalFileName
+	}
+
+	if err := unix.Mkdirat(int(d.fd.Fd()), name, 0755); err != nil {
+		return OpenFailed
+	}
+
+	child, err := openBeneath(d.fd, name, os.O_RDONLY, 0)
+	if err != nil {
+		return OpenFailed
+	}
+
+	node := &Node{
+		path:       d.path + "/" + name,
+		isDir:      true,
+		writable:   true,
+		executable: true,
+		fd:         child,
+		parent:     d.fd,
+		name:       name,
+		root:       d.root,
+		budget:     d.budget,
+	}
+
+	p.Results.SetDir(filesystem.RwDirectory_ServerToClient(node))
+	return nil
 }
 
 func (d *Node) Delete(p filesystem.RwDirectory_delete) error {
-	return NotImplemented
+	name, err := p.Params.Name()
+	if err != nil {
+		return err
+	}
+	if !validFileName(name) {
+		return IllegalFileName
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(int(d.fd.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return OpenFailed
+	}
+
+	flags := 0
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		flags = unix.AT_REMOVEDIR
+	}
+	if err := unix.Unlinkat(int(d.fd.Fd()), name, flags); err != nil {
+		if err == unix.ENOTEMPTY {
+			return NotEmpty
+		}
+		return OpenFailed
+	}
+	return nil
+}
+
+// Rename moves name, a child of d, to newName under newParent.
+// newParent must be a *Node served by this same process, rooted on
+// the same grant as d, and on the same underlying mount; we have no
+// fd to renameat2 against otherwise, cross-mount renames can't be
+// atomic anyway, and without the same-root check two unrelated grants
+// that merely happen to share a mount could splice data between each
+// other, so all three cases are refused rather than attempted. We
+// prefer renameat2(2) with RENAME_NOREPLACE, so an existing
+// destination blocks the rename instead of being silently clobbered,
+// falling back to plain renameat(2) on kernels that lack renameat2(2).
+func (d *Node) Rename(p filesystem.RwDirectory_rename) error {
+	name, err := p.Params.Name()
+	if err != nil {
+		return err
+	}
+	if !validFileName(name) {
+		return IllegalFileName
+	}
+	newName, err := p.Params.NewName()
+	if err != nil {
+		return err
+	}
+	if !validFileName(newName) {
+		return IllegalFileName
+	}
+
+	newParent, ok := localNode(p.Params.NewParent().Client)
+	if !ok {
+		return InvalidArgument
+	}
+	if d.root != newParent.root {
+		return InvalidArgument
+	}
+
+	var srcSt, dstSt unix.Stat_t
+	if err := unix.Fstatat(int(d.fd.Fd()), "", &srcSt, unix.AT_EMPTY_PATH); err != nil {
+		return OpenFailed
+	}
+	if err := unix.Fstatat(int(newParent.fd.Fd()), "", &dstSt, unix.AT_EMPTY_PATH); err != nil {
+		return OpenFailed
+	}
+	if srcSt.Dev != dstSt.Dev {
+		return InvalidArgument
+	}
+
+	err = unix.Renameat2(int(d.fd.Fd()), name, int(newParent.fd.Fd()), newName, unix.RENAME_NOREPLACE)
+	if err == unix.ENOSYS {
+		err = unix.Renameat(int(d.fd.Fd()), name, int(newParent.fd.Fd()), newName)
+	}
+	if err != nil {
+		return OpenFailed
+	}
+	return nil
+}
+
+// localNode recovers the *Node backing client, when client happens
+// to be a capability implemented by this package in this same
+// process. It's used by Rename, which needs a real fd to pass to
+// renameat2 and so can't do anything useful with a capability that
+// isn't actually one of ours.
+func localNode(client capnp.Client) (*Node, bool) {
+	n, ok := client.State().Brand.Value.(*Node)
+	return n, ok
 }
 
 func validFileName(name string) bool {
@@ -256,20 +996,29 @@ func (f *Node) Write(p filesystem.RwFile_write) error {
 		return InvalidArgument
 	}
 
-	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0)
-	if err != nil {
+	sizeHint := p.Params.SizeHint()
+	if err := quotaChecker.CheckQuota(f.fd, sizeHint); err != nil {
 		return err
 	}
+	if b := f.budget; b != nil && sizeHint > atomic.LoadInt64(b) {
+		return ErrNotEnoughDiskSpace
+	}
+
+	file, err := openSelf(f, os.O_WRONLY)
+	if err != nil {
+		return OpenFailed
+	}
 	if startAt == -1 {
-		_, err = file.Seek(0, 2)
+		_, err = file.Seek(0, io.SeekEnd)
 	} else {
-		_, err = file.Seek(startAt, 0)
+		_, err = file.Seek(startAt, io.SeekStart)
 	}
 	if err != nil {
+		file.Close()
 		return err
 	}
 	bs := util_capnp.ByteStream_ServerToClient(&util.WriteCloserByteStream{
-		WC: file,
+		WC: &budgetedWriter{WriteCloser: file, node: f},
 	})
 	p.Results.SetSink(bs)
 	return nil
@@ -277,23 +1026,42 @@ func (f *Node) Write(p filesystem.RwFile_write) error {
 
 func (f *Node) SetExec(p filesystem.RwFile_setExec) error {
 	exec := p.Params.Exec()
-	fi, err := os.Stat(f.path)
+	fi, err := f.fd.Stat()
 	// FIXME: censor error like with OpenFailed.
 	if err != nil {
 		return err
 	}
 	if exec {
 		// FIXME: censor error like with OpenFailed.
-		return os.Chmod(f.path, fi.Mode()|0111)
+		return f.fd.Chmod(fi.Mode() | 0111)
 	} else {
 		// FIXME: censor error like with OpenFailed.
-		return os.Chmod(f.path, fi.Mode()&^0111)
+		return f.fd.Chmod(fi.Mode() &^ 0111)
 	}
 }
 
 func (f *Node) Truncate(p filesystem.RwFile_truncate) error {
 	// FIXME: cast/overflow issues.
-	if err := os.Truncate(f.path, int64(p.Params.Size())); err != nil {
+	size := int64(p.Params.Size())
+
+	if fi, err := f.fd.Stat(); err == nil {
+		if grow := size - fi.Size(); grow > 0 {
+			if err := quotaChecker.CheckQuota(f.fd, grow); err != nil {
+				return err
+			}
+			if !spendBudget(f.budget, grow) {
+				return ErrNotEnoughDiskSpace
+			}
+		}
+	}
+
+	file, err := openSelf(f, os.O_WRONLY)
+	if err != nil {
+		return OpenFailed
+	}
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
 		return OpenFailed
 	}
 	return nil
@@ -315,7 +1083,7 @@ func (f *Node) Read(p filesystem.File_read) error {
 	}
 	sink := p.Params.Sink()
 
-	file, err := os.Open(f.path)
+	file, err := openSelf(f, os.O_RDONLY)
 	if err != nil {
 		return OpenFailed
 	}
@@ -338,4 +1106,4 @@ func (f *Node) Read(p filesystem.File_read) error {
 		io.Copy(wc, r)
 	}()
 	return nil
-}
\ No newline at end of file
+}